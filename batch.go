@@ -15,6 +15,7 @@
 package redis
 
 import (
+	"context"
 	"fmt"
 	"strings"
 )
@@ -23,124 +24,450 @@ import (
 type Batch struct {
 	cluster *Cluster
 	batches []nodeBatch
-	index   []int
+	cmds    []batchCmd
+
+	// Transaction state for an in-progress MULTI...EXEC, scoped to this
+	// Batch so concurrent batches on the same Cluster never interfere
+	// with each other. transactionNode is nil until the first command
+	// after MULTI is put, at which point MULTI is lazily queued against
+	// that one node.
+	transactionEnable bool
+	transactionNode   *redisNode
+	multiIdx          int
+	txResultIdx       []int
 }
 
 type nodeBatch struct {
-	node *redisNode
-	cmds []nodeCommand
+	node    *redisNode
+	cluster *Cluster
+	cmds    []nodeCommand
 
 	err  error
 	done chan int
 }
 
+// defaultMaxRedirects bounds how many times a single pipelined command will
+// follow MOVED/ASK redirects before doBatch gives up, used when the
+// cluster's MaxRedirects is left at its zero value.
+const defaultMaxRedirects = 5
+
 type nodeCommand struct {
 	cmd   string
 	args  []interface{}
 	reply interface{}
 	err   error
+
+	// inTransaction marks a command queued between MULTI and EXEC/DISCARD
+	// (inclusive). resolveRedirects refuses to follow a MOVED/ASK redirect
+	// for these: re-issuing just one of them on a fresh connection would
+	// silently split the transaction across two connections, since
+	// MULTI/EXEC stay on the original one.
+	inTransaction bool
+}
+
+// batchCmd records one logical Put call and the underlying node commands it
+// was expanded into, so RunBatch can reassemble the caller-visible reply in
+// the order Put was called, regardless of how many nodes were involved.
+//
+// kind is empty for a plain, single-node command. For MGET/MSET/MSETNX it
+// names the scattered command so RunBatch knows how to gather the parts
+// back into a single reply. "TXRESULT" marks a command queued inside a
+// MULTI/EXEC transaction, whose real reply must be spliced out of EXEC's
+// array reply rather than read directly. "DISCARDED" marks a transaction
+// command whose result was cancelled by Batch.Discard, and also the MULTI
+// placeholder until MULTI is actually queued on a node.
+type batchCmd struct {
+	kind  string
+	parts []cmdRef
+
+	// exec and txIndex are only set for kind == "TXRESULT": exec points
+	// at the queued EXEC command, and txIndex is this command's position
+	// within the transaction, i.e. its index into EXEC's array reply.
+	exec    cmdRef
+	txIndex int
+}
+
+// cmdRef points at one command queued on one of the batch's node batches.
+type cmdRef struct {
+	node int
+	cmd  int
 }
 
 // NewBatch create a new batch to pack mutiple commands.
 func (cluster *Cluster) NewBatch() *Batch {
 	return &Batch{
-		cluster: cluster,
-		batches: make([]nodeBatch, 0),
-		index:   make([]int, 0),
+		cluster:  cluster,
+		batches:  make([]nodeBatch, 0),
+		cmds:     make([]batchCmd, 0),
+		multiIdx: -1,
 	}
 }
 
-// Put add a redis command to batch, DO NOT put MGET/MSET/MSETNX.
+// Put add a redis command to batch. MGET, MSET and MSETNX are supported:
+// they are transparently split by key slot and scattered across the nodes
+// that own them, then gathered back into a single reply by RunBatch.
 func (batch *Batch) Put(cmd string, args ...interface{}) error {
-	var node *redisNode
-	var err error
-
-	if strings.EqualFold(cmd, "PING") {
+	switch strings.ToUpper(cmd) {
+	case "PING":
 		// random pick 1 node on the target side
-		if node, err = batch.cluster.getRandomNode(); err != nil {
+		node, err := batch.cluster.getRandomNode()
+		if err != nil {
 			return fmt.Errorf("Put PING: %v", err)
 		}
-	} else {
-		switch strings.ToUpper(cmd) {
-		case "MGET":
-			fallthrough
-		case "MSET":
-			fallthrough
-		case "MSETNX":
-			return fmt.Errorf("Put: %s not supported", cmd)
-		case "MULTI":
-			batch.cluster.transactionEnable = true
-		case "EXEC":
-			batch.cluster.transactionEnable = false
-		default:
-			if len(args) < 1 {
-				return fmt.Errorf("Put: no key found in args")
+
+		batch.putSingle(node, cmd, args)
+	case "MGET":
+		if len(args) == 0 {
+			return fmt.Errorf("Put MGET: wrong number of arguments")
+		}
+
+		return batch.putScatter("MGET", args)
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return fmt.Errorf("Put MSET: wrong number of arguments")
+		}
+
+		return batch.putScatter("MSET", args)
+	case "MSETNX":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return fmt.Errorf("Put MSETNX: wrong number of arguments")
+		}
+
+		return batch.putScatter("MSETNX", args)
+	case "MULTI":
+		if batch.transactionEnable {
+			return fmt.Errorf("Put MULTI: nested MULTI not allowed")
+		}
+
+		batch.transactionEnable = true
+		batch.transactionNode = nil
+		batch.multiIdx = len(batch.cmds)
+		// MULTI is only actually queued once we know which node the
+		// transaction belongs to, i.e. when the first command after it
+		// is put; until then this is just a placeholder.
+		batch.cmds = append(batch.cmds, batchCmd{kind: "DISCARDED"})
+	case "EXEC":
+		if !batch.transactionEnable {
+			return fmt.Errorf("Put EXEC: EXEC without MULTI")
+		}
+
+		return batch.putExec()
+	default:
+		if len(args) < 1 {
+			return fmt.Errorf("Put: no key found in args")
+		}
+
+		node, err := batch.cluster.getNodeByKey(args[0])
+		if err != nil {
+			return fmt.Errorf("Put: %v", err)
+		}
+
+		if batch.transactionEnable {
+			if batch.transactionNode == nil {
+				batch.transactionNode = node
+				batch.cmds[batch.multiIdx] = batchCmd{parts: []cmdRef{batch.queue(node, "MULTI", nil, true)}}
+			} else if batch.transactionNode != node {
+				return fmt.Errorf("transaction command[%v] key[%v] not hashed in the same slot",
+					cmd, string(args[0].([]byte)))
 			}
 
-			node, err = batch.cluster.getNodeByKey(args[0])
+			ref := batch.queue(node, cmd, args, true)
+			batch.txResultIdx = append(batch.txResultIdx, len(batch.cmds))
+			batch.cmds = append(batch.cmds, batchCmd{kind: "TXRESULT", parts: []cmdRef{ref}, txIndex: len(batch.txResultIdx) - 1})
+			return nil
+		}
+
+		batch.putSingle(node, cmd, args)
+	}
+
+	return nil
+}
+
+// putExec closes out the current transaction: it queues EXEC on the node
+// MULTI was queued against (picking a random node for a transaction that
+// never put any command), patches every queued TXRESULT to read its real
+// reply out of EXEC's array, and resets the transaction state.
+func (batch *Batch) putExec() error {
+	node := batch.transactionNode
+	if node == nil {
+		// Empty transaction: MULTI was put but nothing followed it, so
+		// MULTI was never actually queued anywhere. Send MULTI and EXEC
+		// back to back on any node to stay protocol-correct.
+		var err error
+		node, err = batch.cluster.getRandomNode()
+		if err != nil {
+			return fmt.Errorf("Put EXEC: %v", err)
+		}
+
+		batch.cmds[batch.multiIdx] = batchCmd{parts: []cmdRef{batch.queue(node, "MULTI", nil, true)}}
+	}
+
+	execRef := batch.queue(node, "EXEC", nil, true)
+
+	for _, idx := range batch.txResultIdx {
+		batch.cmds[idx].exec = execRef
+	}
+
+	batch.cmds = append(batch.cmds, batchCmd{parts: []cmdRef{execRef}})
+
+	batch.transactionEnable = false
+	batch.transactionNode = nil
+	batch.multiIdx = -1
+	batch.txResultIdx = nil
+
+	return nil
+}
+
+// Discard cancels the current transaction: any command already queued
+// since MULTI is sent a DISCARD instead of being executed, and their
+// logical replies resolve to nil.
+func (batch *Batch) Discard() error {
+	if !batch.transactionEnable {
+		return fmt.Errorf("Discard: no transaction in progress")
+	}
+
+	if batch.transactionNode != nil {
+		ref := batch.queue(batch.transactionNode, "DISCARD", nil, true)
+		batch.cmds = append(batch.cmds, batchCmd{parts: []cmdRef{ref}})
+	}
+	// If no command followed MULTI yet, MULTI itself was never queued
+	// against any node, so there is nothing to discard on the wire.
+
+	for _, idx := range batch.txResultIdx {
+		batch.cmds[idx] = batchCmd{kind: "DISCARDED"}
+	}
+
+	if batch.multiIdx >= 0 {
+		batch.cmds[batch.multiIdx] = batchCmd{kind: "DISCARDED"}
+	}
+
+	batch.transactionEnable = false
+	batch.transactionNode = nil
+	batch.multiIdx = -1
+	batch.txResultIdx = nil
+
+	return nil
+}
+
+// putSingle queues cmd/args on node's batch and records it as a plain,
+// one-to-one logical command.
+func (batch *Batch) putSingle(node *redisNode, cmd string, args []interface{}) {
+	ref := batch.queue(node, cmd, args, false)
+	batch.cmds = append(batch.cmds, batchCmd{parts: []cmdRef{ref}})
+}
+
+// putScatter splits a multi-key command's args by slot, queuing one
+// sub-command per key (pair) on the node that owns it, and records the
+// parts under cmd so RunBatch can gather them back into a single reply.
+func (batch *Batch) putScatter(cmd string, args []interface{}) error {
+	var parts []cmdRef
+
+	switch cmd {
+	case "MGET":
+		parts = make([]cmdRef, 0, len(args))
+		for _, key := range args {
+			node, err := batch.cluster.getNodeByKey(key)
 			if err != nil {
-				return fmt.Errorf("Put: %v", err)
+				return fmt.Errorf("Put %s: %v", cmd, err)
 			}
 
-			if batch.cluster.transactionEnable {
-				if batch.cluster.transactionNode == nil {
-					batch.cluster.transactionNode = node
-				} else if batch.cluster.transactionNode != node {
-					return fmt.Errorf("transaction command[%v] key[%v] not hashed in the same slot",
-						cmd, string(args[0].([]byte)))
-				}
+			parts = append(parts, batch.queue(node, "GET", []interface{}{key}, false))
+		}
+	case "MSET", "MSETNX":
+		subCmd := "SET"
+		if cmd == "MSETNX" {
+			subCmd = "SETNX"
+		}
+
+		parts = make([]cmdRef, 0, len(args)/2)
+		for i := 0; i+1 < len(args); i += 2 {
+			key, val := args[i], args[i+1]
+
+			node, err := batch.cluster.getNodeByKey(key)
+			if err != nil {
+				return fmt.Errorf("Put %s: %v", cmd, err)
 			}
+
+			parts = append(parts, batch.queue(node, subCmd, []interface{}{key, val}, false))
 		}
 	}
 
+	batch.cmds = append(batch.cmds, batchCmd{kind: cmd, parts: parts})
+	return nil
+}
+
+// queue appends cmd/args to node's nodeBatch, creating it if this is the
+// first command routed there, and returns a reference to its position.
+// inTransaction marks the command as part of an in-progress MULTI/EXEC, so
+// resolveRedirects knows not to follow a redirect for it independently.
+func (batch *Batch) queue(node *redisNode, cmd string, args []interface{}, inTransaction bool) cmdRef {
 	var i int
 	for i = 0; i < len(batch.batches); i++ {
 		if batch.batches[i].node == node {
-			batch.batches[i].cmds = append(batch.batches[i].cmds,
-				nodeCommand{cmd: cmd, args: args})
-
-			batch.index = append(batch.index, i)
 			break
 		}
 	}
 
 	if i == len(batch.batches) {
 		batch.batches = append(batch.batches,
-			nodeBatch{
-				node: node,
-				cmds: []nodeCommand{{cmd: cmd, args: args}},
-				done: make(chan int)})
-		batch.index = append(batch.index, i)
+			nodeBatch{node: node, cluster: batch.cluster, cmds: make([]nodeCommand, 0, 1), done: make(chan int)})
 	}
 
-	return nil
+	batch.batches[i].cmds = append(batch.batches[i].cmds, nodeCommand{cmd: cmd, args: args, inTransaction: inTransaction})
+
+	return cmdRef{node: i, cmd: len(batch.batches[i].cmds) - 1}
 }
 
-// RunBatch execute commands in batch simutaneously. If multiple commands are 
+// RunBatch execute commands in batch simutaneously. If multiple commands are
 // directed to the same node, they will be merged and sent at once using pipeling.
 func (cluster *Cluster) RunBatch(bat *Batch) ([]interface{}, error) {
+	return cluster.RunBatchContext(context.Background(), bat)
+}
+
+// RunBatchContext is RunBatch with ctx threaded through to every node's
+// pipeline: a deadline on ctx becomes the connection's read/write
+// deadline, and cancelling ctx shuts down in-flight connections so a
+// blocked receive() returns instead of hanging the caller.
+func (cluster *Cluster) RunBatchContext(ctx context.Context, bat *Batch) ([]interface{}, error) {
 	for i := range bat.batches {
-		go doBatch(&bat.batches[i])
+		go doBatch(ctx, &bat.batches[i])
 	}
 
+	// Every batch's done must be drained no matter what, even once ctx is
+	// known to be cancelled: doBatch (and its ctx-watcher goroutine) is
+	// still running and will block forever sending on that unbuffered
+	// channel if nobody is left to receive.
+	var ctxErr error
 	for i := range bat.batches {
-		<-bat.batches[i].done
+		select {
+		case <-bat.batches[i].done:
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+			<-bat.batches[i].done
+		}
+	}
+
+	if ctxErr != nil {
+		return nil, ctxErr
 	}
 
-	var replies []interface{}
-	for _, i := range bat.index {
-		if bat.batches[i].err != nil {
-			return nil, bat.batches[i].err
+	replies := make([]interface{}, 0, len(bat.cmds))
+	for _, bc := range bat.cmds {
+		reply, err := bat.gather(bc)
+		if err != nil {
+			return nil, err
 		}
 
-		replies = append(replies, bat.batches[i].cmds[0].reply)
-		bat.batches[i].cmds = bat.batches[i].cmds[1:]
+		replies = append(replies, reply)
 	}
 
 	return replies, nil
 }
 
-func doBatch(batch *nodeBatch) {
+// DoContext runs a single command through the Batch/RunBatchContext
+// machinery, honoring ctx's deadline and cancellation the same way
+// RunBatchContext does.
+func (cluster *Cluster) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	bat := cluster.NewBatch()
+	if err := bat.Put(cmd, args...); err != nil {
+		return nil, err
+	}
+
+	replies, err := cluster.RunBatchContext(ctx, bat)
+	if err != nil {
+		return nil, err
+	}
+
+	return replies[0], nil
+}
+
+// gather collects the node replies referenced by bc into the single value
+// RunBatch hands back to the caller for that logical Put call.
+func (bat *Batch) gather(bc batchCmd) (interface{}, error) {
+	switch bc.kind {
+	case "":
+		ref := bc.parts[0]
+		nb := &bat.batches[ref.node]
+		if nb.err != nil {
+			return nil, nb.err
+		}
+
+		return nb.cmds[ref.cmd].reply, nil
+	case "MGET":
+		results := make([]interface{}, len(bc.parts))
+		for i, ref := range bc.parts {
+			nb := &bat.batches[ref.node]
+			if nb.err != nil {
+				return nil, nb.err
+			}
+
+			results[i] = nb.cmds[ref.cmd].reply
+		}
+
+		return results, nil
+	case "MSET":
+		for _, ref := range bc.parts {
+			nb := &bat.batches[ref.node]
+			if nb.err != nil {
+				return nil, nb.err
+			}
+
+			if err, ok := nb.cmds[ref.cmd].reply.(error); ok {
+				return nil, err
+			}
+		}
+
+		return "OK", nil
+	case "MSETNX":
+		var allSet int64 = 1
+		for _, ref := range bc.parts {
+			nb := &bat.batches[ref.node]
+			if nb.err != nil {
+				return nil, nb.err
+			}
+
+			if set, _ := nb.cmds[ref.cmd].reply.(int64); set == 0 {
+				allSet = 0
+			}
+		}
+
+		return allSet, nil
+	case "TXRESULT":
+		ackRef := bc.parts[0]
+		nbAck := &bat.batches[ackRef.node]
+		if nbAck.err != nil {
+			return nil, nbAck.err
+		}
+
+		if err, ok := nbAck.cmds[ackRef.cmd].reply.(error); ok {
+			return nil, err
+		} else if ack, ok := nbAck.cmds[ackRef.cmd].reply.([]byte); !ok || !strings.EqualFold(string(ack), "QUEUED") {
+			return nil, fmt.Errorf("RunBatch: expected QUEUED inside transaction, got %v", nbAck.cmds[ackRef.cmd].reply)
+		}
+
+		nbExec := &bat.batches[bc.exec.node]
+		if nbExec.err != nil {
+			return nil, nbExec.err
+		}
+
+		if err, ok := nbExec.cmds[bc.exec.cmd].reply.(error); ok {
+			return nil, err
+		}
+
+		results, ok := nbExec.cmds[bc.exec.cmd].reply.([]interface{})
+		if !ok || bc.txIndex >= len(results) {
+			return nil, fmt.Errorf("RunBatch: EXEC reply missing result for queued command %d", bc.txIndex)
+		}
+
+		return results[bc.txIndex], nil
+	case "DISCARDED":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("RunBatch: unknown scattered command %q", bc.kind)
+	}
+}
+
+func doBatch(ctx context.Context, batch *nodeBatch) {
 	conn, err := batch.node.getConn()
 	if err != nil {
 		batch.err = err
@@ -148,6 +475,23 @@ func doBatch(batch *nodeBatch) {
 		return
 	}
 
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		conn.SetWriteDeadline(deadline)
+	}
+
+	// Abort a blocked flush/receive as soon as ctx is cancelled, by
+	// shutting down the connection out from under it.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.shutdown()
+		case <-stop:
+		}
+	}()
+
 	for i := range batch.cmds {
 		conn.send(batch.cmds[i].cmd, batch.cmds[i].args...)
 	}
@@ -169,9 +513,174 @@ func doBatch(batch *nodeBatch) {
 			return
 		}
 
+		reply, err = batch.resolveRedirects(i, reply)
+		if err != nil {
+			// gather only looks at reply, so carry the error there.
+			reply = err
+		}
 		batch.cmds[i].reply, batch.cmds[i].err = reply, err
 	}
 
 	batch.node.releaseConn(conn)
 	batch.done <- 1
 }
+
+// resolveRedirects follows -MOVED/-ASK replies returned for batch.cmds[i],
+// re-issuing just that command against the node the redirect points to.
+// A MOVED redirect also kicks off a background slot reload so the local
+// slot map converges; an ASK redirect only affects this one command and is
+// preceded by ASKING on the target connection, per the Redis cluster spec.
+//
+// A command queued inside a MULTI/EXEC is never redirected this way: MULTI
+// and EXEC stay on the original connection regardless, so re-issuing just
+// one queued command elsewhere would silently split the transaction across
+// two connections. Instead the whole transaction is failed with an error
+// that says so, so the caller knows to retry it from MULTI, rather than
+// leaving it to surface later as a confusing "expected QUEUED" mismatch.
+func (batch *nodeBatch) resolveRedirects(i int, reply interface{}) (interface{}, error) {
+	cmd := batch.cmds[i]
+
+	if addr, _, ok := parseRedirect(reply); ok && cmd.inTransaction {
+		return nil, fmt.Errorf("doBatch: %s redirected to %s mid-transaction; retry the transaction from MULTI", cmd.cmd, addr)
+	}
+
+	maxRedirects := defaultMaxRedirects
+	if batch.cluster.MaxRedirects > 0 {
+		maxRedirects = batch.cluster.MaxRedirects
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		addr, asking, ok := parseRedirect(reply)
+		if !ok {
+			return reply, nil
+		}
+
+		if attempt >= maxRedirects {
+			return nil, fmt.Errorf("doBatch: %s redirected too many times, last target %s", cmd.cmd, addr)
+		}
+
+		if !asking {
+			go batch.cluster.reloadSlots()
+		}
+
+		reply, err = redirectCmd(batch.cluster, addr, asking, cmd.cmd, cmd.args)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseRedirect reports whether reply is a "-MOVED slot addr" or
+// "-ASK slot addr" cluster redirection error, returning the target address.
+func parseRedirect(reply interface{}) (addr string, asking bool, ok bool) {
+	replyErr, isErr := reply.(error)
+	if !isErr {
+		return "", false, false
+	}
+
+	fields := strings.Fields(replyErr.Error())
+	if len(fields) != 3 {
+		return "", false, false
+	}
+
+	switch fields[0] {
+	case "MOVED":
+		return fields[2], false, true
+	case "ASK":
+		return fields[2], true, true
+	default:
+		return "", false, false
+	}
+}
+
+// redirectCmd opens a connection to the node at addr and re-issues cmd/args
+// against it, sending ASKING first when following an ASK redirect.
+func redirectCmd(cluster *Cluster, addr string, asking bool, cmd string, args []interface{}) (interface{}, error) {
+	node, err := cluster.getNodeByAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := node.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if asking {
+		conn.send("ASKING")
+	}
+	conn.send(cmd, args...)
+
+	if err = conn.flush(); err != nil {
+		conn.shutdown()
+		return nil, err
+	}
+
+	if asking {
+		if _, err = conn.receive(); err != nil {
+			conn.shutdown()
+			return nil, err
+		}
+	}
+
+	reply, err := conn.receive()
+	if err != nil {
+		conn.shutdown()
+		return nil, err
+	}
+
+	node.releaseConn(conn)
+	return reply, nil
+}
+
+// MGet gets the values of all given keys. Keys are grouped by the node that
+// owns their slot, fetched concurrently, and the replies are returned in
+// the same order the keys were given, regardless of how they were split.
+func (cluster *Cluster) MGet(keys ...interface{}) ([]interface{}, error) {
+	bat := cluster.NewBatch()
+	if err := bat.Put("MGET", keys...); err != nil {
+		return nil, err
+	}
+
+	replies, err := cluster.RunBatch(bat)
+	if err != nil {
+		return nil, err
+	}
+
+	return replies[0].([]interface{}), nil
+}
+
+// MSet sets multiple key/value pairs, scattering them across the nodes
+// that own each key's slot. As with real cluster MSET, all keys must still
+// map to valid slots, but unlike single-node MSET the operation is not
+// atomic: each pair is written by its own pipelined SET on its node.
+func (cluster *Cluster) MSet(pairs ...interface{}) error {
+	bat := cluster.NewBatch()
+	if err := bat.Put("MSET", pairs...); err != nil {
+		return err
+	}
+
+	_, err := cluster.RunBatch(bat)
+	return err
+}
+
+// MSetNX sets multiple key/value pairs with one SETNX per key, scattered
+// across the owning nodes. It reports true only if every key was set. Each
+// key is checked and set on its own: keys that did not exist are set even
+// when other keys in the call already existed, so unlike single-node
+// MSETNX the call is not all-or-nothing.
+func (cluster *Cluster) MSetNX(pairs ...interface{}) (bool, error) {
+	bat := cluster.NewBatch()
+	if err := bat.Put("MSETNX", pairs...); err != nil {
+		return false, err
+	}
+
+	replies, err := cluster.RunBatch(bat)
+	if err != nil {
+		return false, err
+	}
+
+	set, _ := replies[0].(int64)
+	return set == 1, nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2015 Joel Wu
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package redis
+
+import (
+	"errors"
+	"testing"
+)
+
+// newGatherBatch builds a Batch with n empty node batches, ready for tests
+// to populate cmds[i].reply/err directly before calling gather.
+func newGatherBatch(n int) *Batch {
+	bat := &Batch{multiIdx: -1, batches: make([]nodeBatch, n)}
+	for i := range bat.batches {
+		bat.batches[i].cmds = make([]nodeCommand, 0, 1)
+	}
+	return bat
+}
+
+func (bat *Batch) put(node int, reply interface{}) cmdRef {
+	nb := &bat.batches[node]
+	nb.cmds = append(nb.cmds, nodeCommand{reply: reply})
+	return cmdRef{node: node, cmd: len(nb.cmds) - 1}
+}
+
+func TestGatherPlain(t *testing.T) {
+	bat := newGatherBatch(1)
+	ref := bat.put(0, []byte("bar"))
+
+	reply, err := bat.gather(batchCmd{parts: []cmdRef{ref}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(reply.([]byte)) != "bar" {
+		t.Fatalf("got %v, want bar", reply)
+	}
+}
+
+func TestGatherPlainNodeError(t *testing.T) {
+	bat := newGatherBatch(1)
+	bat.batches[0].err = errors.New("boom")
+	ref := bat.put(0, nil)
+
+	if _, err := bat.gather(batchCmd{parts: []cmdRef{ref}}); err == nil {
+		t.Fatal("expected error from failed node batch")
+	}
+}
+
+func TestGatherMGET(t *testing.T) {
+	bat := newGatherBatch(2)
+	ref0 := bat.put(0, []byte("v0"))
+	ref1 := bat.put(1, []byte("v1"))
+
+	reply, err := bat.gather(batchCmd{kind: "MGET", parts: []cmdRef{ref0, ref1}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	results := reply.([]interface{})
+	if len(results) != 2 || string(results[0].([]byte)) != "v0" || string(results[1].([]byte)) != "v1" {
+		t.Fatalf("got %v, want [v0 v1]", results)
+	}
+}
+
+func TestGatherMSET(t *testing.T) {
+	t.Run("all ok", func(t *testing.T) {
+		bat := newGatherBatch(2)
+		ref0 := bat.put(0, []byte("OK"))
+		ref1 := bat.put(1, []byte("OK"))
+
+		reply, err := bat.gather(batchCmd{kind: "MSET", parts: []cmdRef{ref0, ref1}})
+		if err != nil || reply.(string) != "OK" {
+			t.Fatalf("got (%v, %v), want (OK, nil)", reply, err)
+		}
+	})
+
+	t.Run("one part errors", func(t *testing.T) {
+		bat := newGatherBatch(1)
+		ref := bat.put(0, errors.New("WRONGTYPE"))
+
+		if _, err := bat.gather(batchCmd{kind: "MSET", parts: []cmdRef{ref}}); err == nil {
+			t.Fatal("expected error surfaced from a scattered SET reply")
+		}
+	})
+}
+
+func TestGatherMSETNX(t *testing.T) {
+	t.Run("all set", func(t *testing.T) {
+		bat := newGatherBatch(2)
+		ref0 := bat.put(0, int64(1))
+		ref1 := bat.put(1, int64(1))
+
+		reply, err := bat.gather(batchCmd{kind: "MSETNX", parts: []cmdRef{ref0, ref1}})
+		if err != nil || reply.(int64) != 1 {
+			t.Fatalf("got (%v, %v), want (1, nil)", reply, err)
+		}
+	})
+
+	t.Run("one not set", func(t *testing.T) {
+		bat := newGatherBatch(2)
+		ref0 := bat.put(0, int64(1))
+		ref1 := bat.put(1, int64(0))
+
+		reply, err := bat.gather(batchCmd{kind: "MSETNX", parts: []cmdRef{ref0, ref1}})
+		if err != nil || reply.(int64) != 0 {
+			t.Fatalf("got (%v, %v), want (0, nil)", reply, err)
+		}
+	})
+}
+
+func TestGatherTXResult(t *testing.T) {
+	bat := newGatherBatch(1)
+	queuedRef := bat.put(0, []byte("QUEUED"))
+	execRef := bat.put(0, []interface{}{int64(42), []byte("bar")})
+
+	reply, err := bat.gather(batchCmd{kind: "TXRESULT", parts: []cmdRef{queuedRef}, exec: execRef, txIndex: 0})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply.(int64) != 42 {
+		t.Fatalf("got %v, want 42", reply)
+	}
+
+	reply, err = bat.gather(batchCmd{kind: "TXRESULT", parts: []cmdRef{queuedRef}, exec: execRef, txIndex: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(reply.([]byte)) != "bar" {
+		t.Fatalf("got %v, want bar", reply)
+	}
+}
+
+func TestGatherTXResultNotQueued(t *testing.T) {
+	bat := newGatherBatch(1)
+	queuedRef := bat.put(0, []byte("OK"))
+
+	if _, err := bat.gather(batchCmd{kind: "TXRESULT", parts: []cmdRef{queuedRef}}); err == nil {
+		t.Fatal("expected error when queued reply isn't QUEUED")
+	}
+}
+
+func TestGatherDiscarded(t *testing.T) {
+	bat := newGatherBatch(0)
+
+	reply, err := bat.gather(batchCmd{kind: "DISCARDED"})
+	if err != nil || reply != nil {
+		t.Fatalf("got (%v, %v), want (nil, nil)", reply, err)
+	}
+}
+
+func TestGatherUnknownKind(t *testing.T) {
+	bat := newGatherBatch(0)
+
+	if _, err := bat.gather(batchCmd{kind: "NOPE"}); err == nil {
+		t.Fatal("expected error for unknown scattered command kind")
+	}
+}
+
+func TestPutMGETRejectsNoKeys(t *testing.T) {
+	bat := &Batch{multiIdx: -1}
+
+	if err := bat.Put("MGET"); err == nil {
+		t.Fatal("expected error for MGET with no keys")
+	}
+}
+
+func TestPutRejectsNestedMulti(t *testing.T) {
+	bat := &Batch{multiIdx: -1}
+
+	if err := bat.Put("MULTI"); err != nil {
+		t.Fatalf("unexpected error starting transaction: %v", err)
+	}
+	if err := bat.Put("MULTI"); err == nil {
+		t.Fatal("expected error for nested MULTI")
+	}
+}
+
+func TestPutExecWithoutMultiRejected(t *testing.T) {
+	bat := &Batch{multiIdx: -1}
+
+	if err := bat.Put("EXEC"); err == nil {
+		t.Fatal("expected error for EXEC without MULTI")
+	}
+}
+
+func TestDiscardWithoutTransactionRejected(t *testing.T) {
+	bat := &Batch{multiIdx: -1}
+
+	if err := bat.Discard(); err == nil {
+		t.Fatal("expected error discarding with no transaction in progress")
+	}
+}
+
+func TestDiscardEmptyTransaction(t *testing.T) {
+	bat := &Batch{multiIdx: -1}
+	if err := bat.Put("MULTI"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := bat.Discard(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if bat.transactionEnable || bat.transactionNode != nil || bat.multiIdx != -1 {
+		t.Fatalf("transaction state not reset: %+v", bat)
+	}
+	if len(bat.batches) != 0 {
+		t.Fatalf("expected no node batch to be created for an empty transaction, got %d", len(bat.batches))
+	}
+	if bat.cmds[0].kind != "DISCARDED" {
+		t.Fatalf("expected MULTI placeholder to be DISCARDED, got %+v", bat.cmds[0])
+	}
+}
+
+// TestTransactionExec exercises the MULTI/EXEC bookkeeping a queued command
+// inside a transaction goes through. Queuing MULTI once the first command's
+// node is known and routing the command itself are replayed by hand, the
+// way Put's default case does them, since key routing needs a live
+// cluster; putExec then patches the TXRESULT entry to splice its reply out
+// of EXEC's array. Node/connection I/O is simulated by writing replies into
+// the node batch directly, the same shape doBatch would leave behind.
+func TestTransactionExec(t *testing.T) {
+	bat := &Batch{multiIdx: -1}
+	if err := bat.Put("MULTI"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	node := new(redisNode)
+	bat.transactionNode = node
+	bat.cmds[bat.multiIdx] = batchCmd{parts: []cmdRef{bat.queue(node, "MULTI", nil, true)}}
+
+	setRef := bat.queue(node, "SET", []interface{}{[]byte("k"), []byte("v")}, true)
+	bat.txResultIdx = append(bat.txResultIdx, len(bat.cmds))
+	bat.cmds = append(bat.cmds, batchCmd{kind: "TXRESULT", parts: []cmdRef{setRef}, txIndex: 0})
+
+	if err := bat.putExec(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bat.transactionEnable {
+		t.Fatal("expected transaction to be closed out by EXEC")
+	}
+	if len(bat.cmds) != 3 {
+		t.Fatalf("got %d logical cmds, want 3 (MULTI, TXRESULT, EXEC)", len(bat.cmds))
+	}
+
+	nb := &bat.batches[0]
+	nb.cmds[0].reply = []byte("OK")                // MULTI reply
+	nb.cmds[1].reply = []byte("QUEUED")            // SET reply
+	nb.cmds[2].reply = []interface{}{[]byte("OK")} // EXEC reply
+
+	if reply, err := bat.gather(bat.cmds[1]); err != nil || string(reply.([]byte)) != "OK" {
+		t.Fatalf("gather(TXRESULT) = (%v, %v), want (OK, nil)", reply, err)
+	}
+	if reply, err := bat.gather(bat.cmds[2]); err != nil || len(reply.([]interface{})) != 1 {
+		t.Fatalf("gather(EXEC) = (%v, %v)", reply, err)
+	}
+}
+
+// TestTransactionStateIsolatedPerBatch guards against the bug this
+// transaction rewrite fixed: transaction state used to live on *Cluster, so
+// two Batches sharing a Cluster would stomp each other's in-progress
+// MULTI. Now it lives on *Batch, so independent Batches can't see each
+// other's transaction state even when built from the same Cluster.
+func TestTransactionStateIsolatedPerBatch(t *testing.T) {
+	cluster := &Cluster{}
+	a := cluster.NewBatch()
+	b := cluster.NewBatch()
+
+	if err := a.Put("MULTI"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if b.transactionEnable {
+		t.Fatal("Batch b observed Batch a's in-progress MULTI")
+	}
+	if err := b.Put("MULTI"); err != nil {
+		t.Fatalf("Batch b should be free to start its own transaction, got: %v", err)
+	}
+}
+
+// TestResolveRedirectsRejectsMidTransactionRedirect pins the fail-safe
+// behavior for a MOVED/ASK reply to a command queued inside an active
+// MULTI/EXEC: resolveRedirects must refuse to re-issue just that one
+// command on a different connection, since MULTI/EXEC themselves stay on
+// the original one and would otherwise silently run as two disjoint
+// transactions. It must fail clearly instead, without attempting any
+// redirect I/O.
+func TestResolveRedirectsRejectsMidTransactionRedirect(t *testing.T) {
+	nb := &nodeBatch{
+		cmds: []nodeCommand{
+			{cmd: "SET", inTransaction: true},
+		},
+	}
+
+	_, err := nb.resolveRedirects(0, errors.New("MOVED 1234 127.0.0.1:7001"))
+	if err == nil {
+		t.Fatal("expected an error instead of following the redirect mid-transaction")
+	}
+}
+
+// TestResolveRedirectsIgnoresNonRedirectReply makes sure a plain reply is
+// passed through untouched, i.e. the mid-transaction guard only kicks in
+// once parseRedirect actually recognizes a MOVED/ASK reply.
+func TestResolveRedirectsIgnoresNonRedirectReply(t *testing.T) {
+	nb := &nodeBatch{
+		cluster: &Cluster{},
+		cmds: []nodeCommand{
+			{cmd: "GET"},
+		},
+	}
+
+	reply, err := nb.resolveRedirects(0, []byte("bar"))
+	if err != nil || string(reply.([]byte)) != "bar" {
+		t.Fatalf("resolveRedirects(%v) = (%v, %v), want (bar, nil)", []byte("bar"), reply, err)
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	cases := []struct {
+		name       string
+		reply      interface{}
+		wantAddr   string
+		wantAsking bool
+		wantOK     bool
+	}{
+		{"moved", errors.New("MOVED 1234 127.0.0.1:7001"), "127.0.0.1:7001", false, true},
+		{"ask", errors.New("ASK 1234 127.0.0.1:7002"), "127.0.0.1:7002", true, true},
+		{"other error", errors.New("WRONGTYPE Operation against a wrong kind of value"), "", false, false},
+		{"malformed", errors.New("MOVED 1234"), "", false, false},
+		{"not an error", []byte("OK"), "", false, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, asking, ok := parseRedirect(c.reply)
+			if addr != c.wantAddr || asking != c.wantAsking || ok != c.wantOK {
+				t.Fatalf("parseRedirect(%v) = (%q, %v, %v), want (%q, %v, %v)",
+					c.reply, addr, asking, ok, c.wantAddr, c.wantAsking, c.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 Joel Wu
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package redis
+
+import "fmt"
+
+// SlotRange describes one contiguous range of hash slots and the master
+// plus replica endpoints serving it, as reported by CLUSTER SLOTS.
+type SlotRange struct {
+	Start    int
+	End      int
+	Master   string
+	Replicas []string
+}
+
+// DoOnNode sends cmd/args directly to the node at addr, bypassing key-based
+// routing. It is meant for cluster-management commands that target a
+// specific node rather than a key's slot.
+func (cluster *Cluster) DoOnNode(addr string, cmd string, args ...interface{}) (interface{}, error) {
+	node, err := cluster.getNodeByAddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("DoOnNode: %v", err)
+	}
+
+	reply, err := doOnNode(node, cmd, args)
+	if err != nil {
+		return nil, fmt.Errorf("DoOnNode: %v", err)
+	}
+
+	return reply, nil
+}
+
+// doOnNode sends a single command to node and waits for its reply, without
+// going through the pipelining Batch machinery. A RESP error reply (e.g.
+// "ERR unknown subcommand") comes back from conn.receive as a normal
+// (reply, nil) pair, so it's surfaced here as the returned error instead of
+// leaving every caller in this file to check for it before their own type
+// assertion.
+func doOnNode(node *redisNode, cmd string, args []interface{}) (interface{}, error) {
+	conn, err := node.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.send(cmd, args...)
+
+	if err := conn.flush(); err != nil {
+		conn.shutdown()
+		return nil, err
+	}
+
+	reply, err := conn.receive()
+	if err != nil {
+		conn.shutdown()
+		return nil, err
+	}
+
+	node.releaseConn(conn)
+
+	if replyErr, ok := reply.(error); ok {
+		return nil, replyErr
+	}
+
+	return reply, nil
+}
+
+// ClusterNodes returns the raw CLUSTER NODES report from a random node.
+func (cluster *Cluster) ClusterNodes() (string, error) {
+	node, err := cluster.getRandomNode()
+	if err != nil {
+		return "", fmt.Errorf("ClusterNodes: %v", err)
+	}
+
+	reply, err := doOnNode(node, "CLUSTER", []interface{}{"NODES"})
+	if err != nil {
+		return "", fmt.Errorf("ClusterNodes: %v", err)
+	}
+
+	raw, ok := reply.([]byte)
+	if !ok {
+		return "", fmt.Errorf("ClusterNodes: unexpected reply type %T", reply)
+	}
+
+	return string(raw), nil
+}
+
+// ClusterInfo returns the raw CLUSTER INFO report from a random node.
+func (cluster *Cluster) ClusterInfo() (string, error) {
+	node, err := cluster.getRandomNode()
+	if err != nil {
+		return "", fmt.Errorf("ClusterInfo: %v", err)
+	}
+
+	reply, err := doOnNode(node, "CLUSTER", []interface{}{"INFO"})
+	if err != nil {
+		return "", fmt.Errorf("ClusterInfo: %v", err)
+	}
+
+	raw, ok := reply.([]byte)
+	if !ok {
+		return "", fmt.Errorf("ClusterInfo: unexpected reply type %T", reply)
+	}
+
+	return string(raw), nil
+}
+
+// ClusterSlots returns the cluster's slot-to-node map, as reported by
+// CLUSTER SLOTS on a random node.
+func (cluster *Cluster) ClusterSlots() ([]SlotRange, error) {
+	node, err := cluster.getRandomNode()
+	if err != nil {
+		return nil, fmt.Errorf("ClusterSlots: %v", err)
+	}
+
+	reply, err := doOnNode(node, "CLUSTER", []interface{}{"SLOTS"})
+	if err != nil {
+		return nil, fmt.Errorf("ClusterSlots: %v", err)
+	}
+
+	rows, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ClusterSlots: unexpected reply type %T", reply)
+	}
+
+	slots := make([]SlotRange, 0, len(rows))
+	for _, row := range rows {
+		fields, ok := row.([]interface{})
+		if !ok || len(fields) < 3 {
+			continue
+		}
+
+		start, _ := fields[0].(int64)
+		end, _ := fields[1].(int64)
+		sr := SlotRange{Start: int(start), End: int(end)}
+
+		for i := 2; i < len(fields); i++ {
+			endpoint, ok := fields[i].([]interface{})
+			if !ok || len(endpoint) < 2 {
+				continue
+			}
+
+			host, _ := endpoint[0].([]byte)
+			port, _ := endpoint[1].(int64)
+			addr := fmt.Sprintf("%s:%d", host, port)
+
+			if i == 2 {
+				sr.Master = addr
+			} else {
+				sr.Replicas = append(sr.Replicas, addr)
+			}
+		}
+
+		slots = append(slots, sr)
+	}
+
+	return slots, nil
+}
+
+// ClusterCountKeysInSlot returns the number of keys currently stored in
+// slot, via CLUSTER COUNTKEYSINSLOT on the node that owns it.
+func (cluster *Cluster) ClusterCountKeysInSlot(slot int) (int64, error) {
+	node, err := cluster.getNodeBySlot(slot)
+	if err != nil {
+		return 0, fmt.Errorf("ClusterCountKeysInSlot: %v", err)
+	}
+
+	reply, err := doOnNode(node, "CLUSTER", []interface{}{"COUNTKEYSINSLOT", slot})
+	if err != nil {
+		return 0, fmt.Errorf("ClusterCountKeysInSlot: %v", err)
+	}
+
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("ClusterCountKeysInSlot: unexpected reply type %T", reply)
+	}
+
+	return count, nil
+}
+
+// ClusterGetKeysInSlot returns up to count keys stored in slot, via
+// CLUSTER GETKEYSINSLOT on the node that owns it.
+func (cluster *Cluster) ClusterGetKeysInSlot(slot, count int) ([]string, error) {
+	node, err := cluster.getNodeBySlot(slot)
+	if err != nil {
+		return nil, fmt.Errorf("ClusterGetKeysInSlot: %v", err)
+	}
+
+	reply, err := doOnNode(node, "CLUSTER", []interface{}{"GETKEYSINSLOT", slot, count})
+	if err != nil {
+		return nil, fmt.Errorf("ClusterGetKeysInSlot: %v", err)
+	}
+
+	rows, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ClusterGetKeysInSlot: unexpected reply type %T", reply)
+	}
+
+	keys := make([]string, 0, len(rows))
+	for _, row := range rows {
+		key, ok := row.([]byte)
+		if !ok {
+			continue
+		}
+		keys = append(keys, string(key))
+	}
+
+	return keys, nil
+}
+
+// ClusterForget runs CLUSTER FORGET nodeID against the node at addr,
+// telling it to remove nodeID from its view of the cluster.
+func (cluster *Cluster) ClusterForget(addr, nodeID string) error {
+	if _, err := cluster.DoOnNode(addr, "CLUSTER", "FORGET", nodeID); err != nil {
+		return fmt.Errorf("ClusterForget: %v", err)
+	}
+
+	return nil
+}
+
+// ClusterReset runs CLUSTER RESET against the node at addr. hard selects
+// RESET HARD (wipes node ID and known cluster state) over the default
+// RESET SOFT.
+func (cluster *Cluster) ClusterReset(addr string, hard bool) error {
+	mode := "SOFT"
+	if hard {
+		mode = "HARD"
+	}
+
+	if _, err := cluster.DoOnNode(addr, "CLUSTER", "RESET", mode); err != nil {
+		return fmt.Errorf("ClusterReset: %v", err)
+	}
+
+	return nil
+}
+
+// ClusterFailover runs CLUSTER FAILOVER against the replica at addr,
+// optionally passing FORCE or TAKEOVER; pass an empty opt for a regular,
+// non-forced failover.
+func (cluster *Cluster) ClusterFailover(addr string, opt string) error {
+	if opt == "" {
+		if _, err := cluster.DoOnNode(addr, "CLUSTER", "FAILOVER"); err != nil {
+			return fmt.Errorf("ClusterFailover: %v", err)
+		}
+
+		return nil
+	}
+
+	if _, err := cluster.DoOnNode(addr, "CLUSTER", "FAILOVER", opt); err != nil {
+		return fmt.Errorf("ClusterFailover: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,462 @@
+// Copyright 2015 Joel Wu
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package redis
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Message is a single message pushed by Redis to a subscribed channel or
+// pattern.
+type Message struct {
+	// Channel is the channel the message was published to.
+	Channel string
+	// Pattern is set only when the message was delivered through a
+	// PSUBSCRIBE match; it holds the pattern that matched.
+	Pattern string
+	// Data is the published payload.
+	Data []byte
+}
+
+// PubSubConn is a live subscription obtained from Cluster.Subscribe,
+// Cluster.PSubscribe or Cluster.SSubscribe. It owns one dedicated,
+// non-pooled connection per node it needs to talk to and multiplexes
+// every node's pushed messages onto a single channel.
+type PubSubConn struct {
+	cluster *Cluster
+	sharded bool
+
+	mu     sync.Mutex
+	conns  map[*redisNode]*pubsubConn
+	closed bool
+	wg     sync.WaitGroup
+
+	msgs chan Message
+	done chan struct{}
+}
+
+// pubsubConn tracks the dedicated connection to one node, along with the
+// channels/patterns it currently carries so it can be re-subscribed after
+// a reconnect.
+type pubsubConn struct {
+	node     *redisNode
+	conn     *redisConn
+	channels map[string]bool
+	patterns map[string]bool
+
+	// confirms carries replies readLoop reads off conn that aren't pushed
+	// messages (i.e. subscribe/unsubscribe confirmations) back to whoever
+	// is waiting on them, since readLoop is the only goroutine allowed to
+	// call conn.receive once it has started.
+	confirms chan interface{}
+}
+
+// Subscribe opens a subscription to the given channels. Regular Redis
+// pub/sub is not partitioned by slot - any node sees every PUBLISH in the
+// cluster - so Subscribe uses a single connection to one random node.
+func (cluster *Cluster) Subscribe(channels ...string) (*PubSubConn, error) {
+	return cluster.newPubSub(false, "SUBSCRIBE", channels)
+}
+
+// PSubscribe opens a subscription matching the given glob-style patterns.
+// Like Subscribe, it uses a single connection since regular pub/sub is not
+// slot-sharded.
+func (cluster *Cluster) PSubscribe(patterns ...string) (*PubSubConn, error) {
+	return cluster.newPubSub(false, "PSUBSCRIBE", patterns)
+}
+
+// SSubscribe opens a Redis 7+ sharded pub/sub subscription (SSUBSCRIBE).
+// Sharded messages are only ever seen by the node owning the channel's
+// slot, so SSubscribe groups the channels by getNodeByKey and opens one
+// subscriber connection per node involved, multiplexing them all onto the
+// returned PubSubConn's message channel.
+func (cluster *Cluster) SSubscribe(channels ...string) (*PubSubConn, error) {
+	return cluster.newPubSub(true, "SSUBSCRIBE", channels)
+}
+
+func (cluster *Cluster) newPubSub(sharded bool, cmd string, items []string) (*PubSubConn, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%s: no channels given", cmd)
+	}
+
+	psc := &PubSubConn{
+		cluster: cluster,
+		sharded: sharded,
+		conns:   make(map[*redisNode]*pubsubConn),
+		msgs:    make(chan Message, 64),
+		done:    make(chan struct{}),
+	}
+
+	if !sharded {
+		node, err := cluster.getRandomNode()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cmd, err)
+		}
+
+		if err := psc.addNode(node, cmd, items); err != nil {
+			psc.Close()
+			return nil, err
+		}
+
+		return psc, nil
+	}
+
+	byNode := make(map[*redisNode][]string)
+	for _, channel := range items {
+		node, err := cluster.getNodeByKey(channel)
+		if err != nil {
+			psc.Close()
+			return nil, fmt.Errorf("%s: %v", cmd, err)
+		}
+
+		byNode[node] = append(byNode[node], channel)
+	}
+
+	for node, channels := range byNode {
+		if err := psc.addNode(node, cmd, channels); err != nil {
+			psc.Close()
+			return nil, err
+		}
+	}
+
+	return psc, nil
+}
+
+// addNode dials a fresh connection to node, issues cmd for items on it and,
+// once the server has confirmed every one, starts a goroutine delivering
+// its pushed messages onto psc.msgs.
+func (psc *PubSubConn) addNode(node *redisNode, cmd string, items []string) error {
+	conn, err := node.dial()
+	if err != nil {
+		return fmt.Errorf("%s: %v", cmd, err)
+	}
+
+	if err := sendAndConfirm(conn, cmd, items); err != nil {
+		conn.shutdown()
+		return fmt.Errorf("%s: %v", cmd, err)
+	}
+
+	pc := &pubsubConn{
+		node:     node,
+		conn:     conn,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		confirms: make(chan interface{}),
+	}
+
+	if cmd == "PSUBSCRIBE" {
+		for _, item := range items {
+			pc.patterns[item] = true
+		}
+	} else {
+		for _, item := range items {
+			pc.channels[item] = true
+		}
+	}
+
+	psc.mu.Lock()
+	psc.conns[node] = pc
+	psc.mu.Unlock()
+
+	psc.wg.Add(1)
+	go psc.readLoop(pc)
+
+	return nil
+}
+
+// sendAndConfirm issues cmd once per item and waits for the corresponding
+// subscribe-confirmation reply Redis pushes back for each one, in order.
+func sendAndConfirm(conn *redisConn, cmd string, items []string) error {
+	for _, item := range items {
+		conn.send(cmd, item)
+	}
+
+	if err := conn.flush(); err != nil {
+		return err
+	}
+
+	for range items {
+		if _, err := conn.receive(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitConfirm issues cmd once per item on conn and waits for each
+// confirmation reply via pc.confirms rather than calling conn.receive
+// itself, since readLoop already owns all reads off pc.conn once a
+// subscription is up and running. conn is passed in rather than read from
+// pc so the caller can snapshot it while holding psc.mu and then call
+// waitConfirm without the lock held, since it blocks until readLoop
+// forwards a reply.
+func (psc *PubSubConn) waitConfirm(pc *pubsubConn, conn *redisConn, cmd string, items []string) error {
+	for _, item := range items {
+		conn.send(cmd, item)
+	}
+
+	if err := conn.flush(); err != nil {
+		return err
+	}
+
+	for range items {
+		select {
+		case <-pc.confirms:
+		case <-psc.done:
+			return fmt.Errorf("%s: connection closed", cmd)
+		}
+	}
+
+	return nil
+}
+
+// readLoop delivers pc's pushed messages onto psc.msgs until the
+// connection fails in a way reconnect cannot recover from, or psc is
+// closed. It owns every read of pc.conn: a reply that isn't a pushed
+// message is a subscribe/unsubscribe confirmation, which it hands to
+// whoever is waiting via pc.confirms instead of reading it directly,
+// since two goroutines calling conn.receive concurrently would race.
+func (psc *PubSubConn) readLoop(pc *pubsubConn) {
+	defer psc.wg.Done()
+
+	for {
+		reply, err := pc.conn.receive()
+		if err != nil {
+			pc.conn.shutdown()
+			if !psc.reconnect(pc) {
+				return
+			}
+			continue
+		}
+
+		msg, ok := parseMessage(reply)
+		if !ok {
+			select {
+			case pc.confirms <- reply:
+			case <-psc.done:
+				return
+			}
+			continue
+		}
+
+		select {
+		case psc.msgs <- msg:
+		case <-psc.done:
+			return
+		}
+	}
+}
+
+// reconnect re-dials pc's node and re-subscribes to everything it was
+// carrying. For a sharded subscription the slot may have failed over, so
+// the owning node is re-resolved from one of the subscribed channels
+// before dialing.
+func (psc *PubSubConn) reconnect(pc *pubsubConn) bool {
+	psc.mu.Lock()
+	if psc.closed {
+		psc.mu.Unlock()
+		return false
+	}
+
+	node := pc.node
+	if psc.sharded {
+		for channel := range pc.channels {
+			if n, err := psc.cluster.getNodeByKey(channel); err == nil {
+				node = n
+			}
+			break
+		}
+	}
+	cmd, items := pc.subscribeCmd(psc.sharded)
+	psc.mu.Unlock()
+
+	conn, err := node.dial()
+	if err != nil {
+		return false
+	}
+
+	if err := sendAndConfirm(conn, cmd, items); err != nil {
+		conn.shutdown()
+		return false
+	}
+
+	psc.mu.Lock()
+	pc.node = node
+	pc.conn = conn
+	psc.mu.Unlock()
+
+	return true
+}
+
+// subscribeCmd rebuilds the (command, items) pair needed to restore pc's
+// current channel/pattern set after a reconnect.
+func (pc *pubsubConn) subscribeCmd(sharded bool) (string, []string) {
+	if len(pc.patterns) > 0 {
+		items := make([]string, 0, len(pc.patterns))
+		for pattern := range pc.patterns {
+			items = append(items, pattern)
+		}
+		return "PSUBSCRIBE", items
+	}
+
+	items := make([]string, 0, len(pc.channels))
+	for channel := range pc.channels {
+		items = append(items, channel)
+	}
+
+	if sharded {
+		return "SSUBSCRIBE", items
+	}
+	return "SUBSCRIBE", items
+}
+
+// parseMessage decodes a pushed "message"/"pmessage"/"smessage" reply into
+// a Message, reporting false for anything else (e.g. subscribe/unsubscribe
+// confirmations, which are consumed separately).
+func parseMessage(reply interface{}) (Message, bool) {
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) < 3 {
+		return Message{}, false
+	}
+
+	kind, ok := parts[0].([]byte)
+	if !ok {
+		return Message{}, false
+	}
+
+	switch string(kind) {
+	case "message", "smessage":
+		channel, _ := parts[1].([]byte)
+		data, _ := parts[2].([]byte)
+		return Message{Channel: string(channel), Data: data}, true
+	case "pmessage":
+		if len(parts) < 4 {
+			return Message{}, false
+		}
+		pattern, _ := parts[1].([]byte)
+		channel, _ := parts[2].([]byte)
+		data, _ := parts[3].([]byte)
+		return Message{Pattern: string(pattern), Channel: string(channel), Data: data}, true
+	default:
+		return Message{}, false
+	}
+}
+
+// Messages returns the channel Message values are delivered on. It is
+// closed after Close has shut down every underlying connection.
+func (psc *PubSubConn) Messages() <-chan Message {
+	return psc.msgs
+}
+
+// Unsubscribe stops delivery for the given channels.
+func (psc *PubSubConn) Unsubscribe(channels ...string) error {
+	cmd := "UNSUBSCRIBE"
+	if psc.sharded {
+		cmd = "SUNSUBSCRIBE"
+	}
+	return psc.remove(cmd, channels, false)
+}
+
+// PUnsubscribe stops delivery for the given patterns.
+func (psc *PubSubConn) PUnsubscribe(patterns ...string) error {
+	return psc.remove("PUNSUBSCRIBE", patterns, true)
+}
+
+// pendingRemoval is one node's share of a remove() call: the items to drop
+// and the connection they must be sent on, snapshotted while psc.mu was
+// held so remove can let go of it before blocking on the confirmation.
+type pendingRemoval struct {
+	pc   *pubsubConn
+	conn *redisConn
+	mine []string
+}
+
+func (psc *PubSubConn) remove(cmd string, items []string, isPattern bool) error {
+	psc.mu.Lock()
+	var pending []pendingRemoval
+	for _, pc := range psc.conns {
+		set := pc.channels
+		if isPattern {
+			set = pc.patterns
+		}
+
+		var mine []string
+		for _, item := range items {
+			if set[item] {
+				mine = append(mine, item)
+			}
+		}
+
+		if len(mine) > 0 {
+			pending = append(pending, pendingRemoval{pc: pc, conn: pc.conn, mine: mine})
+		}
+	}
+	psc.mu.Unlock()
+
+	// waitConfirm blocks on readLoop to forward the confirmation, so it
+	// must run without psc.mu held: holding it here would deadlock against
+	// reconnect (and Close) if this connection drops mid-wait, since both
+	// also need psc.mu.
+	for _, p := range pending {
+		if err := psc.waitConfirm(p.pc, p.conn, cmd, p.mine); err != nil {
+			return err
+		}
+
+		psc.mu.Lock()
+		set := p.pc.channels
+		if isPattern {
+			set = p.pc.patterns
+		}
+		for _, item := range p.mine {
+			delete(set, item)
+		}
+		psc.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Close unsubscribes from everything and shuts down every underlying
+// connection. It is safe to call more than once.
+func (psc *PubSubConn) Close() error {
+	psc.mu.Lock()
+	if psc.closed {
+		psc.mu.Unlock()
+		return nil
+	}
+	psc.closed = true
+
+	conns := make([]*pubsubConn, 0, len(psc.conns))
+	for _, pc := range psc.conns {
+		conns = append(conns, pc)
+	}
+	psc.mu.Unlock()
+
+	close(psc.done)
+
+	var err error
+	for _, pc := range conns {
+		if e := pc.conn.shutdown(); e != nil {
+			err = e
+		}
+	}
+
+	psc.wg.Wait()
+	close(psc.msgs)
+
+	return err
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Joel Wu
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package redis
+
+import "testing"
+
+func TestParseMessage(t *testing.T) {
+	t.Run("message", func(t *testing.T) {
+		reply := []interface{}{[]byte("message"), []byte("chan"), []byte("hello")}
+		msg, ok := parseMessage(reply)
+		if !ok || msg.Channel != "chan" || string(msg.Data) != "hello" || msg.Pattern != "" {
+			t.Fatalf("got (%+v, %v), want {Channel:chan Data:hello}", msg, ok)
+		}
+	})
+
+	t.Run("smessage", func(t *testing.T) {
+		reply := []interface{}{[]byte("smessage"), []byte("shard"), []byte("payload")}
+		msg, ok := parseMessage(reply)
+		if !ok || msg.Channel != "shard" || string(msg.Data) != "payload" {
+			t.Fatalf("got (%+v, %v), want {Channel:shard Data:payload}", msg, ok)
+		}
+	})
+
+	t.Run("pmessage", func(t *testing.T) {
+		reply := []interface{}{[]byte("pmessage"), []byte("news.*"), []byte("news.tech"), []byte("body")}
+		msg, ok := parseMessage(reply)
+		if !ok || msg.Pattern != "news.*" || msg.Channel != "news.tech" || string(msg.Data) != "body" {
+			t.Fatalf("got (%+v, %v), want {Pattern:news.* Channel:news.tech Data:body}", msg, ok)
+		}
+	})
+
+	t.Run("pmessage too short", func(t *testing.T) {
+		reply := []interface{}{[]byte("pmessage"), []byte("news.*"), []byte("news.tech")}
+		if _, ok := parseMessage(reply); ok {
+			t.Fatal("expected false for truncated pmessage")
+		}
+	})
+
+	t.Run("subscribe confirmation is not a message", func(t *testing.T) {
+		reply := []interface{}{[]byte("subscribe"), []byte("chan"), int64(1)}
+		if _, ok := parseMessage(reply); ok {
+			t.Fatal("expected false for subscribe confirmation")
+		}
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		if _, ok := parseMessage([]byte("OK")); ok {
+			t.Fatal("expected false for non-array reply")
+		}
+	})
+
+	t.Run("first element not bytes", func(t *testing.T) {
+		reply := []interface{}{int64(1), []byte("chan"), []byte("hello")}
+		if _, ok := parseMessage(reply); ok {
+			t.Fatal("expected false when reply kind isn't a byte string")
+		}
+	})
+}